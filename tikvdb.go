@@ -21,14 +21,47 @@ func init() {
 }
 
 type TikvDB struct {
-	txn  *txnkv.Client
-	lock sync.RWMutex
-	name string
-	dir  string
+	txn   *txnkv.Client
+	lock  sync.RWMutex
+	name  string
+	dir   string
+	cache tikvCache
+
+	holderID  string
+	stopLease chan struct{}
+	leaseWG   sync.WaitGroup
 }
 
 var _ DB = (*TikvDB)(nil)
 
+// TikvDBOption customizes a TikvDB created via NewTikvDBWithOpts.
+type TikvDBOption func(*tikvDBOptions)
+
+type tikvDBOptions struct {
+	clientOpts []txnkv.ClientOpt
+	cache      tikvCache
+	cacheSet   bool
+}
+
+// WithClientOpts forwards additional txnkv.ClientOpt values to
+// txnkv.NewClient when the underlying TiKV client is created.
+func WithClientOpts(opts ...txnkv.ClientOpt) TikvDBOption {
+	return func(o *tikvDBOptions) {
+		o.clientOpts = append(o.clientOpts, opts...)
+	}
+}
+
+// WithCache injects a pre-built tikvCache, bypassing the cache built from
+// FlagTikvDBCacheSizeMB/FlagTikvDBCacheTTL. Passing a nil cache disables
+// caching outright. This exists mainly so tests can swap in a fake or
+// instrumented cache implementation.
+func WithCache(cache tikvCache) TikvDBOption {
+	return func(o *tikvDBOptions) {
+		o.cache = cache
+		o.cacheSet = true
+	}
+}
+
 func NewTikvDB(name string, dir string) (*TikvDB, error) {
 	addrs := viper.GetStringSlice(FlagTikvDBAddrs)
 	if len(addrs) == 0 {
@@ -36,46 +69,58 @@ func NewTikvDB(name string, dir string) (*TikvDB, error) {
 	}
 	//params := parseOptParams(viper.GetString(FlagTikvDBOpts))
 
-	return NewTikvDBWithOpts(name, dir, addrs, nil)
+	return NewTikvDBWithOpts(name, dir, addrs)
 }
 
-func NewTikvDBWithOpts(name string, dir string, pdAddrs []string, _ ...txnkv.ClientOpt) (*TikvDB, error) {
+func NewTikvDBWithOpts(name string, dir string, pdAddrs []string, opts ...TikvDBOption) (*TikvDB, error) {
+	options := tikvDBOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
 	// Initializing the tikv client
-	txnClient, err := txnkv.NewClient(pdAddrs)
+	txnClient, err := txnkv.NewClient(pdAddrs, options.clientOpts...)
 	if err != nil {
 		return nil, err
 	}
 
+	cache := options.cache
+	if !options.cacheSet {
+		if sizeMB := viper.GetInt(FlagTikvDBCacheSizeMB); sizeMB > 0 {
+			cache = newShardedLRUCache(sizeMB, viper.GetDuration(FlagTikvDBCacheTTL))
+		}
+	}
+
 	database := &TikvDB{
-		txn:  txnClient,
-		name: name,
-		dir:  dir,
-	}
-
-	// Performs prefix data check. If the prefix exists, an error is returned.
-	//txn, err := database.txn.Begin()
-	//if err != nil {
-	//	return nil, err
-	//}
-	//defer txn.Commit(context.Background())
-	//_, err = txn.Get(context.Background(), database.getTikvStateKey())
-	//if err == nil {
-	//	return nil, fmt.Errorf("database '%s/%s' is already in use", dir, name)
-	//}
-	//if err != nil {
-	//	if !tikverr.IsErrNotFound(err) {
-	//		return nil, fmt.Errorf("database '%s/%s' is already in use", dir, name)
-	//	}
-	//}
-	//err = txn.Set(database.getTikvStateKey(), []byte("1"))
-	//if err != nil {
-	//	return nil, err
-	//}
+		txn:       txnClient,
+		name:      name,
+		dir:       dir,
+		cache:     cache,
+		holderID:  newStateLeaseHolderID(),
+		stopLease: make(chan struct{}),
+	}
+
+	// Take an exclusive lease on the state key so a second open of the same
+	// name/dir fails instead of silently sharing the prefix with us.
+	if err := database.acquireStateLease(); err != nil {
+		_ = txnClient.Close()
+		return nil, fmt.Errorf("database '%s/%s' is already in use: %w", dir, name, err)
+	}
+
+	database.leaseWG.Add(1)
+	go database.refreshStateLease()
 
 	return database, nil
 }
 
 func (t *TikvDB) Get(key []byte) ([]byte, error) {
+	tikvKey := t.getTikvKey(key)
+	if t.cache != nil {
+		if cached, ok := t.cache.Get(tikvKey); ok {
+			return cp(cached), nil
+		}
+	}
+
 	txn, err := t.txn.Begin()
 	if err != nil {
 		return nil, err
@@ -84,17 +129,28 @@ func (t *TikvDB) Get(key []byte) ([]byte, error) {
 		err = txn.Commit(context.Background())
 	}()
 
-	val, err := txn.Get(context.Background(), t.getTikvKey(key))
+	val, err := txn.Get(context.Background(), tikvKey)
 	if err != nil {
 		if tikverr.IsErrNotFound(err) {
 			return nil, nil
 		}
 		return nil, err
 	}
-	return checkEmptyValue(val), err
+	result := checkEmptyValue(val)
+	if t.cache != nil {
+		t.cache.Set(cp(tikvKey), cp(result))
+	}
+	return result, err
 }
 
 func (t *TikvDB) Has(key []byte) (bool, error) {
+	tikvKey := t.getTikvKey(key)
+	if t.cache != nil {
+		if _, ok := t.cache.Get(tikvKey); ok {
+			return true, nil
+		}
+	}
+
 	txn, err := t.txn.Begin()
 	if err != nil {
 		return false, err
@@ -103,7 +159,7 @@ func (t *TikvDB) Has(key []byte) (bool, error) {
 		err = txn.Commit(context.Background())
 	}()
 
-	_, err = txn.Get(context.Background(), t.getTikvKey(key))
+	_, err = txn.Get(context.Background(), tikvKey)
 	if err == nil {
 		return true, nil
 	}
@@ -122,19 +178,29 @@ func (t *TikvDB) SetSync(key []byte, value []byte) error {
 }
 
 func (t *TikvDB) setKV(key []byte, value []byte) error {
+	tikvKey := t.getTikvKey(key)
+	storedValue := setNotEmptyValue(value)
+
 	txn, err := t.txn.Begin()
 	if err != nil {
 		return err
 	}
-	defer func() {
-		err = txn.Commit(context.Background())
-	}()
 
-	err = txn.Set(t.getTikvKey(key), setNotEmptyValue(value))
-	if err != nil {
+	if err := txn.Set(tikvKey, storedValue); err != nil {
+		_ = txn.Rollback()
+		return err
+	}
+
+	// The cache is only updated once the write has actually landed, so a
+	// failed Set or Commit can never leave readers with a cached value that
+	// was never written to TiKV.
+	if err := txn.Commit(context.Background()); err != nil {
 		return err
 	}
-	return err
+	if t.cache != nil {
+		t.cache.Set(cp(tikvKey), cp(value))
+	}
+	return nil
 }
 
 func (t *TikvDB) Delete(key []byte) error {
@@ -146,37 +212,42 @@ func (t *TikvDB) DeleteSync(key []byte) error {
 }
 
 func (t *TikvDB) deleteKey(key []byte) error {
+	tikvKey := t.getTikvKey(key)
+
 	txn, err := t.txn.Begin()
 	if err != nil {
 		return err
 	}
-	defer func() {
-		err = txn.Commit(context.Background())
-	}()
 
-	err = txn.Delete(t.getTikvKey(key))
-	if err != nil {
+	if err := txn.Delete(tikvKey); err != nil {
+		_ = txn.Rollback()
 		return err
 	}
-	return err
+
+	// See setKV: only evict from the cache once the delete has actually
+	// committed, so a failed delete can't still get memoized as if it had
+	// succeeded.
+	if err := txn.Commit(context.Background()); err != nil {
+		return err
+	}
+	if t.cache != nil {
+		t.cache.Delete(tikvKey)
+	}
+	return nil
 }
 
 func (t *TikvDB) Close() (err error) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
-	txn, err := t.txn.Begin()
-	if err != nil {
-		return err
-	}
-	defer func() {
-		err = txn.Commit(context.Background())
-	}()
-	err = txn.Delete(t.getTikvStateKey())
-	if err != nil {
-		return err
+	close(t.stopLease)
+	t.leaseWG.Wait()
+
+	if t.cache != nil {
+		t.cache.PurgePrefix([]byte(t.tikvStoreKeyPrefix()))
 	}
-	return nil
+
+	return t.releaseStateLease()
 }
 
 func (t *TikvDB) Print() error {
@@ -201,6 +272,11 @@ func (t *TikvDB) Stats() map[string]string {
 	stats := make(map[string]string)
 	stats["database.type"] = "tikvDB"
 	stats["database.prefix"] = t.tikvStoreKeyPrefix()
+	if t.cache != nil {
+		hits, misses := t.cache.Stats()
+		stats["cache.hits"] = fmt.Sprintf("%d", hits)
+		stats["cache.misses"] = fmt.Sprintf("%d", misses)
+	}
 	return stats
 }
 
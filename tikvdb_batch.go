@@ -1,6 +1,14 @@
 package db
 
-import "context"
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
 
 // keyvalue is a key-value tuple tagged with a deletion field to allow creating
 // memory-database write batches.
@@ -59,17 +67,222 @@ func (b *tikvDBBatch) WriteSync() error {
 	return b.write(true)
 }
 
-// write writes the batch to TiKV.
+// AtomicBatch is implemented by batches that can also commit all of their
+// staged writes as a single transaction, bypassing FlagTikvDBBatchMaxBytes/
+// FlagTikvDBBatchParallelism sharding entirely. Callers that need the
+// all-or-nothing guarantee a plain Write/WriteSync no longer makes - such as
+// CacheDB.Write's multi-step state transitions - should type-assert for this
+// instead of relying on Write.
+type AtomicBatch interface {
+	// WriteAtomic commits every staged write in one transaction, either all
+	// of it lands or none of it does.
+	WriteAtomic() error
+}
+
+var _ AtomicBatch = (*tikvDBBatch)(nil)
+
+// WriteAtomic commits the whole batch as a single transaction, regardless of
+// FlagTikvDBBatchMaxBytes/FlagTikvDBBatchParallelism.
+func (b *tikvDBBatch) WriteAtomic() error {
+	if err := b.commitSubBatch(dedupeWrites(b.writes)); err != nil {
+		return &BatchWriteError{SubBatch: 0, Err: err}
+	}
+	return nil
+}
+
+// BatchWriteError reports which sub-batch of a coalesced Batch.Write failed
+// to commit. Batch.write shards writes across several sub-transactions, so
+// a partial failure must name which slice needs retrying rather than
+// leaving the caller to guess which of the batch's writes actually landed.
+type BatchWriteError struct {
+	SubBatch int
+	Err      error
+}
+
+func (e *BatchWriteError) Error() string {
+	return fmt.Sprintf("tikvdb: batch write failed committing sub-batch %d: %v", e.SubBatch, e.Err)
+}
+
+func (e *BatchWriteError) Unwrap() error {
+	return e.Err
+}
+
+// BatchWriteErrors reports every sub-batch that failed to commit, sorted by
+// sub-batch index so the result is deterministic regardless of which
+// sub-batch's goroutine happened to finish first.
+type BatchWriteErrors []*BatchWriteError
+
+func (e BatchWriteErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, sub := range e {
+		msgs[i] = sub.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e BatchWriteErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, sub := range e {
+		errs[i] = sub
+	}
+	return errs
+}
+
+// write shards the batch into sub-transactions bounded by
+// FlagTikvDBBatchMaxBytes (TiKV's own txn size limit otherwise applies),
+// commits them with up to FlagTikvDBBatchParallelism workers in flight, and
+// updates the host DB's cache (if any) for each sub-batch that commits
+// successfully, so readers never observe a value that is stale with
+// respect to the just-committed writes. If more than one sub-batch fails,
+// the returned BatchWriteErrors names all of them (sorted by sub-batch
+// index), not just whichever failed first, so a caller can tell which
+// sub-batches still need retrying.
+//
+// Sharding sub-transactions across goroutines means they can land in any
+// order, so a batch that Sets then Deletes (or vice versa) the same key
+// across two shards would otherwise have its outcome decided by goroutine
+// scheduling instead of insertion order. dedupeWrites collapses the batch
+// down to one write per key, keeping the last one, before it is ever split
+// into shards, so each key is only ever touched by a single sub-transaction.
+//
+// This does mean write is no longer atomic across shards: if one
+// sub-transaction fails after others have already committed, the batch is
+// left partially applied. Callers that need all-or-nothing semantics should
+// use WriteAtomic instead.
 func (b *tikvDBBatch) write(_ bool) error {
+	subBatches := b.shard(dedupeWrites(b.writes))
+	if len(subBatches) == 0 {
+		return nil
+	}
+
+	parallelism := viper.GetInt(FlagTikvDBBatchParallelism)
+	if parallelism <= 0 {
+		parallelism = 1
+	}
+
+	var (
+		wg    sync.WaitGroup
+		sem   = make(chan struct{}, parallelism)
+		errMu sync.Mutex
+		errs  BatchWriteErrors
+	)
+
+	for i, sub := range subBatches {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, sub []keyvalue) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := b.commitSubBatch(sub); err != nil {
+				errMu.Lock()
+				errs = append(errs, &BatchWriteError{SubBatch: i, Err: err})
+				errMu.Unlock()
+			}
+		}(i, sub)
+	}
+	wg.Wait()
+
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].SubBatch < errs[j].SubBatch })
+	return errs
+}
+
+// dedupeWrites collapses writes down to one entry per key, last write wins,
+// preserving the position of that last occurrence. This keeps the result of
+// a batch deterministic once it may be split across independently-ordered
+// sub-transactions: a Set and a later Delete of the same key always resolve
+// to the Delete, never to whichever sub-transaction's goroutine happened to
+// commit last.
+func dedupeWrites(writes []keyvalue) []keyvalue {
+	lastIdx := make(map[string]int, len(writes))
+	for i, keyValue := range writes {
+		lastIdx[string(keyValue.key)] = i
+	}
+
+	deduped := make([]keyvalue, 0, len(lastIdx))
+	for i, keyValue := range writes {
+		if lastIdx[string(keyValue.key)] == i {
+			deduped = append(deduped, keyValue)
+		}
+	}
+	return deduped
+}
+
+// shard splits writes into ordered slices, each capped at
+// FlagTikvDBBatchMaxBytes of accumulated key+value size.
+func (b *tikvDBBatch) shard(writes []keyvalue) [][]keyvalue {
+	maxBytes := viper.GetInt64(FlagTikvDBBatchMaxBytes)
+	if maxBytes <= 0 {
+		maxBytes = defaultTikvDBBatchMaxBytes
+	}
+
+	var (
+		subBatches  [][]keyvalue
+		current     []keyvalue
+		currentSize int64
+	)
+	for _, keyValue := range writes {
+		size := int64(len(keyValue.key) + len(keyValue.value))
+		if len(current) > 0 && currentSize+size > maxBytes {
+			subBatches = append(subBatches, current)
+			current = nil
+			currentSize = 0
+		}
+		current = append(current, keyValue)
+		currentSize += size
+	}
+	if len(current) > 0 {
+		subBatches = append(subBatches, current)
+	}
+	return subBatches
+}
+
+// subEligibleForAsyncCommit reports whether sub is small enough, by both key
+// count and accumulated key+value size, to be a safe candidate for TiKV's
+// async-commit/1PC path.
+func subEligibleForAsyncCommit(sub []keyvalue) bool {
+	maxKeys := viper.GetInt(FlagTikvDBAsyncCommitMaxKeys)
+	if maxKeys <= 0 {
+		maxKeys = defaultTikvDBAsyncCommitMaxKeys
+	}
+	if len(sub) > maxKeys {
+		return false
+	}
+
+	maxBytes := viper.GetInt64(FlagTikvDBAsyncCommitMaxBytes)
+	if maxBytes <= 0 {
+		maxBytes = defaultTikvDBAsyncCommitMaxBytes
+	}
+	var size int64
+	for _, keyValue := range sub {
+		size += int64(len(keyValue.key) + len(keyValue.value))
+		if size > maxBytes {
+			return false
+		}
+	}
+	return true
+}
+
+// commitSubBatch applies one shard of the batch in its own transaction. It
+// only opts into TiKV's async-commit/1PC path when FlagTikvDBAsyncCommit is
+// set and sub is small enough, per FlagTikvDBAsyncCommitMaxBytes/
+// FlagTikvDBAsyncCommitMaxKeys, for 1PC to actually help; FlagTikvDBBatchMaxBytes
+// alone bounds shards far too large for that to be safe.
+func (b *tikvDBBatch) commitSubBatch(sub []keyvalue) error {
 	txn, err := b.db.txn.Begin()
 	if err != nil {
 		return err
 	}
-	defer func() {
-		err = txn.Commit(context.Background())
-	}()
 
-	for _, keyValue := range b.writes {
+	if viper.GetBool(FlagTikvDBAsyncCommit) && subEligibleForAsyncCommit(sub) {
+		txn.SetEnableAsyncCommit(true)
+		txn.SetEnable1PC(true)
+	}
+
+	for _, keyValue := range sub {
 		if keyValue.delete {
 			if err := txn.Delete(keyValue.key); err != nil {
 				return err
@@ -80,7 +293,21 @@ func (b *tikvDBBatch) write(_ bool) error {
 			return err
 		}
 	}
-	return err
+
+	if err := txn.Commit(context.Background()); err != nil {
+		return err
+	}
+
+	if b.db.cache != nil {
+		for _, keyValue := range sub {
+			if keyValue.delete {
+				b.db.cache.Delete(cp(keyValue.key))
+			} else {
+				b.db.cache.Set(cp(keyValue.key), cp(checkEmptyValue(keyValue.value)))
+			}
+		}
+	}
+	return nil
 }
 
 // Close resets the batch for reuse.
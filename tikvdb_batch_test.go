@@ -0,0 +1,108 @@
+package db
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	errTestA = errors.New("sub-batch a failed")
+	errTestB = errors.New("sub-batch b failed")
+)
+
+func TestDedupeWritesKeepsLastWritePerKey(t *testing.T) {
+	writes := []keyvalue{
+		{key: []byte("a"), value: []byte("1")},
+		{key: []byte("b"), value: []byte("1")},
+		{key: []byte("a"), value: []byte("2")},
+		{key: []byte("a"), delete: true},
+	}
+
+	deduped := dedupeWrites(writes)
+
+	require.Equal(t, []keyvalue{
+		{key: []byte("b"), value: []byte("1")},
+		{key: []byte("a"), delete: true},
+	}, deduped)
+}
+
+func TestDedupeWritesNoDuplicatesIsUnchanged(t *testing.T) {
+	writes := []keyvalue{
+		{key: []byte("a"), value: []byte("1")},
+		{key: []byte("b"), value: []byte("2")},
+	}
+
+	require.Equal(t, writes, dedupeWrites(writes))
+}
+
+func TestBatchShardSplitsOnMaxBytes(t *testing.T) {
+	viper.Set(FlagTikvDBBatchMaxBytes, int64(4))
+	defer viper.Set(FlagTikvDBBatchMaxBytes, nil)
+
+	b := &tikvDBBatch{}
+	writes := []keyvalue{
+		{key: []byte("a"), value: []byte("1")}, // size 2
+		{key: []byte("b"), value: []byte("1")}, // size 2, fills shard to 4
+		{key: []byte("c"), value: []byte("1")}, // size 2, starts a new shard
+	}
+
+	shards := b.shard(writes)
+
+	require.Equal(t, [][]keyvalue{
+		{writes[0], writes[1]},
+		{writes[2]},
+	}, shards)
+}
+
+func TestBatchShardEmptyWritesYieldsNoShards(t *testing.T) {
+	b := &tikvDBBatch{}
+	require.Empty(t, b.shard(nil))
+}
+
+func TestSubEligibleForAsyncCommitKeyCount(t *testing.T) {
+	viper.Set(FlagTikvDBAsyncCommitMaxKeys, 1)
+	defer viper.Set(FlagTikvDBAsyncCommitMaxKeys, nil)
+
+	single := []keyvalue{{key: []byte("a"), value: []byte("1")}}
+	require.True(t, subEligibleForAsyncCommit(single))
+
+	pair := []keyvalue{{key: []byte("a"), value: []byte("1")}, {key: []byte("b"), value: []byte("1")}}
+	require.False(t, subEligibleForAsyncCommit(pair))
+}
+
+func TestSubEligibleForAsyncCommitByteSize(t *testing.T) {
+	viper.Set(FlagTikvDBAsyncCommitMaxBytes, int64(2))
+	defer viper.Set(FlagTikvDBAsyncCommitMaxBytes, nil)
+
+	small := []keyvalue{{key: []byte("a"), value: []byte("1")}}
+	require.True(t, subEligibleForAsyncCommit(small))
+
+	large := []keyvalue{{key: []byte("a"), value: []byte("123")}}
+	require.False(t, subEligibleForAsyncCommit(large))
+}
+
+func TestBatchWriteErrorsUnwrapAll(t *testing.T) {
+	errs := BatchWriteErrors{
+		{SubBatch: 0, Err: errTestA},
+		{SubBatch: 1, Err: errTestB},
+	}
+
+	unwrapped := errs.Unwrap()
+	require.Len(t, unwrapped, 2)
+	require.ErrorIs(t, unwrapped[0], errTestA)
+	require.ErrorIs(t, unwrapped[1], errTestB)
+}
+
+func TestBatchWriteErrorsErrorNamesEverySubBatch(t *testing.T) {
+	errs := BatchWriteErrors{
+		{SubBatch: 0, Err: errTestA},
+		{SubBatch: 2, Err: errTestB},
+	}
+
+	msg := errs.Error()
+	require.Contains(t, msg, "sub-batch 0")
+	require.Contains(t, msg, "sub-batch 2")
+}
@@ -0,0 +1,201 @@
+package db
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tikvDBCacheShards is the number of independent LRU segments the cache is
+// split into. Sharding keeps lock contention low under the highly concurrent
+// point-read workloads (state and IAVL lookups) that motivated this cache.
+const tikvDBCacheShards = 32
+
+// tikvCache is a write-through/read-through cache that sits in front of a
+// TikvDB. It is consulted on every Get/Has and kept consistent with every
+// Set/Delete that commits successfully, so readers never observe a value
+// that is stale with respect to TiKV. Implementations must be safe for
+// concurrent use.
+//
+// NewTikvDBWithOpts accepts a WithCache option so tests can inject a fake or
+// instrumented implementation instead of the default shardedLRUCache.
+type tikvCache interface {
+	// Get returns the cached value for key and true, or (nil, false) if the
+	// key is not cached or has expired.
+	Get(key []byte) ([]byte, bool)
+	// Set stores value under key, evicting older entries as needed.
+	Set(key, value []byte)
+	// Delete removes key from the cache, if present.
+	Delete(key []byte)
+	// PurgePrefix evicts every cached entry whose key starts with prefix.
+	// TikvDB.Close uses this to drop only the entries it owns, since a
+	// cache instance may be shared across several TikvDB prefixes.
+	PurgePrefix(prefix []byte)
+	// Stats reports cumulative hit/miss counts since creation.
+	Stats() (hits, misses uint64)
+}
+
+// cacheEntry is the value stored behind each list.Element in a lruShard.
+type cacheEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+// lruShard is one independently-locked segment of a shardedLRUCache.
+type lruShard struct {
+	mu       sync.Mutex
+	ll       *list.List
+	items    map[string]*list.Element
+	curBytes int64
+	maxBytes int64
+	ttl      time.Duration
+}
+
+func newLRUShard(maxBytes int64, ttl time.Duration) *lruShard {
+	return &lruShard{
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+		maxBytes: maxBytes,
+		ttl:      ttl,
+	}
+}
+
+func (s *lruShard) get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if s.ttl > 0 && time.Now().After(entry.expiresAt) {
+		s.removeElement(elem)
+		return nil, false
+	}
+	s.ll.MoveToFront(elem)
+	return entry.value, true
+}
+
+func (s *lruShard) set(key string, value []byte) {
+	if s.maxBytes <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	size := int64(len(key) + len(value))
+	if elem, ok := s.items[key]; ok {
+		entry := elem.Value.(*cacheEntry)
+		s.curBytes += size - int64(len(key)+len(entry.value))
+		entry.value = value
+		if s.ttl > 0 {
+			entry.expiresAt = time.Now().Add(s.ttl)
+		}
+		s.ll.MoveToFront(elem)
+	} else {
+		entry := &cacheEntry{key: key, value: value}
+		if s.ttl > 0 {
+			entry.expiresAt = time.Now().Add(s.ttl)
+		}
+		s.items[key] = s.ll.PushFront(entry)
+		s.curBytes += size
+	}
+
+	for s.curBytes > s.maxBytes {
+		oldest := s.ll.Back()
+		if oldest == nil {
+			break
+		}
+		s.removeElement(oldest)
+	}
+}
+
+func (s *lruShard) delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.items[key]; ok {
+		s.removeElement(elem)
+	}
+}
+
+// removeElement must be called with s.mu held.
+func (s *lruShard) removeElement(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	s.ll.Remove(elem)
+	delete(s.items, entry.key)
+	s.curBytes -= int64(len(entry.key) + len(entry.value))
+}
+
+func (s *lruShard) purgePrefix(prefix string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, elem := range s.items {
+		if len(prefix) == 0 || (len(key) >= len(prefix) && key[:len(prefix)] == prefix) {
+			s.removeElement(elem)
+		}
+	}
+}
+
+// shardedLRUCache is the default tikvCache implementation: a fixed number of
+// independently-locked, size-bounded LRU segments, analogous to a
+// bigcache-style shard-locked cache.
+type shardedLRUCache struct {
+	shards [tikvDBCacheShards]*lruShard
+	hits   uint64
+	misses uint64
+}
+
+var _ tikvCache = (*shardedLRUCache)(nil)
+
+// newShardedLRUCache builds a cache capped at sizeMB megabytes in total,
+// split evenly across tikvDBCacheShards segments. A ttl of 0 disables
+// time-based expiry; a sizeMB of 0 disables the cache entirely.
+func newShardedLRUCache(sizeMB int, ttl time.Duration) *shardedLRUCache {
+	maxShardBytes := int64(sizeMB) * 1024 * 1024 / tikvDBCacheShards
+	c := &shardedLRUCache{}
+	for i := range c.shards {
+		c.shards[i] = newLRUShard(maxShardBytes, ttl)
+	}
+	return c
+}
+
+func (c *shardedLRUCache) shardFor(key []byte) *lruShard {
+	h := fnv.New32a()
+	h.Write(key)
+	return c.shards[h.Sum32()%tikvDBCacheShards]
+}
+
+func (c *shardedLRUCache) Get(key []byte) ([]byte, bool) {
+	value, ok := c.shardFor(key).get(string(key))
+	if ok {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+	return value, ok
+}
+
+func (c *shardedLRUCache) Set(key, value []byte) {
+	c.shardFor(key).set(string(key), value)
+}
+
+func (c *shardedLRUCache) Delete(key []byte) {
+	c.shardFor(key).delete(string(key))
+}
+
+func (c *shardedLRUCache) PurgePrefix(prefix []byte) {
+	for _, shard := range c.shards {
+		shard.purgePrefix(string(prefix))
+	}
+}
+
+func (c *shardedLRUCache) Stats() (hits, misses uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
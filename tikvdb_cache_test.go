@@ -0,0 +1,88 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardedLRUCacheGetSetDelete(t *testing.T) {
+	c := newShardedLRUCache(1, 0)
+
+	_, ok := c.Get([]byte("a"))
+	require.False(t, ok)
+
+	c.Set([]byte("a"), []byte("1"))
+	val, ok := c.Get([]byte("a"))
+	require.True(t, ok)
+	require.Equal(t, []byte("1"), val)
+
+	c.Delete([]byte("a"))
+	_, ok = c.Get([]byte("a"))
+	require.False(t, ok)
+}
+
+func TestShardedLRUCacheTTL(t *testing.T) {
+	c := newShardedLRUCache(1, 10*time.Millisecond)
+
+	c.Set([]byte("a"), []byte("1"))
+	_, ok := c.Get([]byte("a"))
+	require.True(t, ok)
+
+	time.Sleep(20 * time.Millisecond)
+	_, ok = c.Get([]byte("a"))
+	require.False(t, ok, "entry should have expired")
+}
+
+func TestLRUShardEviction(t *testing.T) {
+	// Sized just large enough for one small entry, so every subsequent set
+	// evicts the least-recently-used one.
+	shard := newLRUShard(3, 0)
+
+	shard.set("a", []byte("1"))
+	shard.set("b", []byte("2"))
+
+	_, aOK := shard.get("a")
+	_, bOK := shard.get("b")
+	require.False(t, aOK, "oldest entry should have been evicted")
+	require.True(t, bOK)
+}
+
+func TestShardedLRUCachePurgePrefix(t *testing.T) {
+	c := newShardedLRUCache(1, 0)
+
+	c.Set([]byte("app1/a"), []byte("1"))
+	c.Set([]byte("app1/b"), []byte("2"))
+	c.Set([]byte("app2/a"), []byte("3"))
+
+	c.PurgePrefix([]byte("app1/"))
+
+	_, ok := c.Get([]byte("app1/a"))
+	require.False(t, ok)
+	_, ok = c.Get([]byte("app1/b"))
+	require.False(t, ok)
+	val, ok := c.Get([]byte("app2/a"))
+	require.True(t, ok)
+	require.Equal(t, []byte("3"), val)
+}
+
+func TestShardedLRUCacheStats(t *testing.T) {
+	c := newShardedLRUCache(1, 0)
+
+	c.Set([]byte("a"), []byte("1"))
+	c.Get([]byte("a"))
+	c.Get([]byte("missing"))
+
+	hits, misses := c.Stats()
+	require.EqualValues(t, 1, hits)
+	require.EqualValues(t, 1, misses)
+}
+
+func TestShardedLRUCacheZeroSizeDisablesStorage(t *testing.T) {
+	c := newShardedLRUCache(0, 0)
+
+	c.Set([]byte("a"), []byte("1"))
+	_, ok := c.Get([]byte("a"))
+	require.False(t, ok)
+}
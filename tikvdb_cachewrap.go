@@ -0,0 +1,424 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/google/btree"
+)
+
+// tikvCacheDBBTreeDegree mirrors the degree cometbft-db's memDB uses for its
+// own btree-backed sorted map.
+const tikvCacheDBBTreeDegree = 32
+
+// CacheDB is a DB that stages Set/Delete operations in memory and only
+// forwards them to the underlying store when Write is called, or drops
+// them on Discard. It lets callers build an atomic multi-step state
+// transition (e.g. an IAVL commit, or ABCI DeliverTx staging) out of many
+// small writes against TiKV without paying for one transaction per key.
+type CacheDB interface {
+	DB
+
+	// Write flushes the staged writes to the underlying TikvDB as a single
+	// transaction and clears the buffer.
+	Write() error
+	// Discard drops every staged write without touching the underlying
+	// TikvDB.
+	Discard()
+}
+
+// cacheItem is the unit stored in tikvCacheDB's btree buffer. delete marks
+// the entry as a tombstone rather than an absence, so a buffered delete can
+// shadow a value that still exists in the underlying TikvDB.
+type cacheItem struct {
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+func (i *cacheItem) Less(other btree.Item) bool {
+	return bytes.Compare(i.key, other.(*cacheItem).key) < 0
+}
+
+// tikvCacheDB is the CacheWrap()-returned staged write buffer. Reads consult
+// the buffer first and fall back to the wrapped TikvDB on miss; iterators
+// merge the buffer with the underlying range scan in sorted order.
+type tikvCacheDB struct {
+	db     *TikvDB
+	mtx    sync.RWMutex
+	buffer *btree.BTree
+}
+
+var _ CacheDB = (*tikvCacheDB)(nil)
+
+// CacheWrap returns a CacheDB that stages writes against t in memory.
+func (t *TikvDB) CacheWrap() CacheDB {
+	return &tikvCacheDB{db: t, buffer: btree.New(tikvCacheDBBTreeDegree)}
+}
+
+func (c *tikvCacheDB) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, errKeyEmpty
+	}
+
+	c.mtx.RLock()
+	item := c.buffer.Get(&cacheItem{key: key})
+	c.mtx.RUnlock()
+
+	if item != nil {
+		ci := item.(*cacheItem)
+		if ci.delete {
+			return nil, nil
+		}
+		return cp(ci.value), nil
+	}
+	return c.db.Get(key)
+}
+
+func (c *tikvCacheDB) Has(key []byte) (bool, error) {
+	if len(key) == 0 {
+		return false, errKeyEmpty
+	}
+
+	c.mtx.RLock()
+	item := c.buffer.Get(&cacheItem{key: key})
+	c.mtx.RUnlock()
+
+	if item != nil {
+		return !item.(*cacheItem).delete, nil
+	}
+	return c.db.Has(key)
+}
+
+func (c *tikvCacheDB) Set(key, value []byte) error {
+	if len(key) == 0 {
+		return errKeyEmpty
+	}
+	if value == nil {
+		return errValueNil
+	}
+
+	c.mtx.Lock()
+	c.buffer.ReplaceOrInsert(&cacheItem{key: cp(key), value: cp(value)})
+	c.mtx.Unlock()
+	return nil
+}
+
+func (c *tikvCacheDB) SetSync(key, value []byte) error {
+	return c.Set(key, value)
+}
+
+func (c *tikvCacheDB) Delete(key []byte) error {
+	if len(key) == 0 {
+		return errKeyEmpty
+	}
+
+	c.mtx.Lock()
+	c.buffer.ReplaceOrInsert(&cacheItem{key: cp(key), delete: true})
+	c.mtx.Unlock()
+	return nil
+}
+
+func (c *tikvCacheDB) DeleteSync(key []byte) error {
+	return c.Delete(key)
+}
+
+// Write flushes every staged write to TiKV as a single all-or-nothing
+// transaction, then clears the buffer. It relies on the underlying batch
+// implementing AtomicBatch - a plain Batch.Write/WriteSync may shard across
+// several independently-committed sub-transactions, which would break the
+// atomic multi-step state transitions CacheDB promises its callers.
+func (c *tikvCacheDB) Write() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	batch := c.db.NewBatch()
+	defer batch.Close()
+
+	atomic, ok := batch.(AtomicBatch)
+	if !ok {
+		return fmt.Errorf("tikvdb: batch %T does not support atomic writes", batch)
+	}
+
+	var writeErr error
+	c.buffer.Ascend(func(i btree.Item) bool {
+		ci := i.(*cacheItem)
+		if ci.delete {
+			writeErr = batch.Delete(ci.key)
+		} else {
+			writeErr = batch.Set(ci.key, ci.value)
+		}
+		return writeErr == nil
+	})
+	if writeErr != nil {
+		return writeErr
+	}
+
+	if err := atomic.WriteAtomic(); err != nil {
+		return err
+	}
+	c.buffer = btree.New(tikvCacheDBBTreeDegree)
+	return nil
+}
+
+// Discard drops every staged write without touching TiKV.
+func (c *tikvCacheDB) Discard() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.buffer = btree.New(tikvCacheDBBTreeDegree)
+}
+
+func (c *tikvCacheDB) Close() error {
+	c.Discard()
+	return nil
+}
+
+func (c *tikvCacheDB) Print() error {
+	itr, err := c.Iterator(nil, nil)
+	if err != nil {
+		return err
+	}
+	defer itr.Close()
+	for ; itr.Valid(); itr.Next() {
+		fmt.Printf("[%X]:\t[%X]\n", itr.Key(), itr.Value())
+	}
+	return itr.Error()
+}
+
+func (c *tikvCacheDB) Stats() map[string]string {
+	stats := c.db.Stats()
+	stats["database.type"] = "tikvCacheDB"
+	return stats
+}
+
+func (c *tikvCacheDB) NewBatch() Batch {
+	return newTikvCacheDBBatch(c)
+}
+
+func (c *tikvCacheDB) Iterator(start, end []byte) (Iterator, error) {
+	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
+		return nil, errKeyEmpty
+	}
+	parent, err := c.db.Iterator(start, end)
+	if err != nil {
+		return nil, err
+	}
+	return newCacheMergeIterator(c.collect(start, end, false), parent, start, end, false), nil
+}
+
+func (c *tikvCacheDB) ReverseIterator(start, end []byte) (Iterator, error) {
+	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
+		return nil, errKeyEmpty
+	}
+	parent, err := c.db.ReverseIterator(start, end)
+	if err != nil {
+		return nil, err
+	}
+	return newCacheMergeIterator(c.collect(start, end, true), parent, start, end, true), nil
+}
+
+// collect takes a point-in-time, direction-ordered snapshot of the buffered
+// entries within [start, end), including tombstones, for the merge
+// iterator to walk alongside the underlying TikvDB scan.
+func (c *tikvCacheDB) collect(start, end []byte, reverse bool) []*cacheItem {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	var items []*cacheItem
+	visit := func(i btree.Item) bool {
+		ci := i.(*cacheItem)
+		if start != nil && bytes.Compare(ci.key, start) < 0 {
+			return true
+		}
+		if end != nil && bytes.Compare(ci.key, end) >= 0 {
+			return true
+		}
+		items = append(items, ci)
+		return true
+	}
+
+	if reverse {
+		c.buffer.Descend(visit)
+	} else {
+		c.buffer.Ascend(visit)
+	}
+	return items
+}
+
+// cacheMergeIterator merges a sorted snapshot of staged writes with the
+// underlying TikvDB iterator, preferring the staged entry on key collision
+// and honoring deletes as tombstones.
+type cacheMergeIterator struct {
+	items   []*cacheItem
+	idx     int
+	parent  Iterator
+	reverse bool
+	start   []byte
+	end     []byte
+}
+
+var _ Iterator = (*cacheMergeIterator)(nil)
+
+func newCacheMergeIterator(items []*cacheItem, parent Iterator, start, end []byte, reverse bool) *cacheMergeIterator {
+	itr := &cacheMergeIterator{items: items, parent: parent, start: start, end: end, reverse: reverse}
+	itr.skipTombstones()
+	return itr
+}
+
+func (itr *cacheMergeIterator) cacheValid() bool {
+	return itr.idx < len(itr.items)
+}
+
+func (itr *cacheMergeIterator) cacheKey() []byte {
+	return itr.items[itr.idx].key
+}
+
+func (itr *cacheMergeIterator) less(a, b []byte) bool {
+	if itr.reverse {
+		return bytes.Compare(a, b) > 0
+	}
+	return bytes.Compare(a, b) < 0
+}
+
+// cacheIsCurrent reports whether the staged entry at itr.idx is the next
+// entry to yield, giving it priority over the parent on a tied key.
+func (itr *cacheMergeIterator) cacheIsCurrent() bool {
+	if !itr.cacheValid() {
+		return false
+	}
+	if !itr.parent.Valid() {
+		return true
+	}
+	ck, pk := itr.cacheKey(), itr.parent.Key()
+	if bytes.Equal(ck, pk) {
+		return true
+	}
+	return itr.less(ck, pk)
+}
+
+// skipTombstones advances past any leading deleted staged entries,
+// consuming the shadowed parent entry along the way, until the head of the
+// merge is a visible entry or both sources are exhausted.
+func (itr *cacheMergeIterator) skipTombstones() {
+	for itr.cacheIsCurrent() && itr.items[itr.idx].delete {
+		ck := itr.cacheKey()
+		if itr.parent.Valid() && bytes.Equal(itr.parent.Key(), ck) {
+			itr.parent.Next()
+		}
+		itr.idx++
+	}
+}
+
+func (itr *cacheMergeIterator) Domain() (start []byte, end []byte) {
+	return itr.start, itr.end
+}
+
+func (itr *cacheMergeIterator) Valid() bool {
+	return itr.cacheValid() || itr.parent.Valid()
+}
+
+func (itr *cacheMergeIterator) Next() {
+	itr.assertIsValid()
+	if itr.cacheIsCurrent() {
+		ck := itr.cacheKey()
+		if itr.parent.Valid() && bytes.Equal(itr.parent.Key(), ck) {
+			itr.parent.Next()
+		}
+		itr.idx++
+	} else {
+		itr.parent.Next()
+	}
+	itr.skipTombstones()
+}
+
+func (itr *cacheMergeIterator) Key() []byte {
+	itr.assertIsValid()
+	if itr.cacheIsCurrent() {
+		return itr.cacheKey()
+	}
+	return itr.parent.Key()
+}
+
+func (itr *cacheMergeIterator) Value() []byte {
+	itr.assertIsValid()
+	if itr.cacheIsCurrent() {
+		return itr.items[itr.idx].value
+	}
+	return itr.parent.Value()
+}
+
+func (itr *cacheMergeIterator) Error() error {
+	return itr.parent.Error()
+}
+
+func (itr *cacheMergeIterator) Close() error {
+	return itr.parent.Close()
+}
+
+func (itr *cacheMergeIterator) assertIsValid() {
+	if !itr.Valid() {
+		panic("iterator is invalid")
+	}
+}
+
+// tikvCacheDBBatch stages writes the same way tikvDBBatch does, but flushes
+// them into the owning tikvCacheDB's buffer instead of a TiKV transaction;
+// the buffer itself is only flushed to TiKV by a later CacheDB.Write.
+type tikvCacheDBBatch struct {
+	cache  *tikvCacheDB
+	writes []keyvalue
+}
+
+var _ Batch = (*tikvCacheDBBatch)(nil)
+
+func newTikvCacheDBBatch(cache *tikvCacheDB) *tikvCacheDBBatch {
+	return &tikvCacheDBBatch{cache: cache}
+}
+
+func (b *tikvCacheDBBatch) Set(key, value []byte) error {
+	if len(key) == 0 {
+		return errKeyEmpty
+	}
+	if value == nil {
+		return errValueNil
+	}
+	b.writes = append(b.writes, keyvalue{key, value, false})
+	return nil
+}
+
+func (b *tikvCacheDBBatch) Delete(key []byte) error {
+	if len(key) == 0 {
+		return errKeyEmpty
+	}
+	b.writes = append(b.writes, keyvalue{key, nil, true})
+	return nil
+}
+
+func (b *tikvCacheDBBatch) Write() error {
+	return b.write()
+}
+
+func (b *tikvCacheDBBatch) WriteSync() error {
+	return b.write()
+}
+
+func (b *tikvCacheDBBatch) write() error {
+	for _, kv := range b.writes {
+		if kv.delete {
+			if err := b.cache.Delete(kv.key); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := b.cache.Set(kv.key, kv.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *tikvCacheDBBatch) Close() error {
+	b.writes = b.writes[:0]
+	return nil
+}
@@ -0,0 +1,55 @@
+package db
+
+// Viper configuration keys for the TikvDB backend. FlagTikvDBAddrs is
+// declared alongside the rest of the backend's flags; the ones below
+// configure the optional read cache described in tikvdb_cache.go and the
+// sharding and async-commit behaviour of Batch.Write in tikvdb_batch.go.
+const (
+	// FlagTikvDBCacheSizeMB sets the total size, in megabytes, of the
+	// in-memory read cache fronting TiKV. A value of 0 disables the cache.
+	FlagTikvDBCacheSizeMB = "tikv.cache.size-mb"
+
+	// FlagTikvDBCacheTTL sets how long a cached entry remains valid before
+	// it is treated as a miss, e.g. "30s". A value of 0 means entries never
+	// expire on their own and are only evicted by the LRU policy.
+	FlagTikvDBCacheTTL = "tikv.cache.ttl"
+
+	// FlagTikvDBBatchMaxBytes caps the accumulated key+value size of a
+	// single sub-transaction a Batch.Write shards its writes into. Zero
+	// falls back to defaultTikvDBBatchMaxBytes, TiKV's own txn size limit.
+	FlagTikvDBBatchMaxBytes = "tikv.batch.max-bytes"
+
+	// FlagTikvDBBatchParallelism bounds how many of a batch's sub-transactions
+	// are committed concurrently. Zero (the default) commits one at a time.
+	FlagTikvDBBatchParallelism = "tikv.batch.parallelism"
+
+	// FlagTikvDBAsyncCommit opts a sub-transaction into TiKV's async-commit
+	// and one-phase-commit paths, but only when it also falls under the much
+	// smaller FlagTikvDBAsyncCommitMaxBytes/FlagTikvDBAsyncCommitMaxKeys
+	// bounds - FlagTikvDBBatchMaxBytes alone is too large a transaction for
+	// 1PC to be a safe default.
+	FlagTikvDBAsyncCommit = "tikv.batch.async-commit"
+
+	// FlagTikvDBAsyncCommitMaxBytes caps the accumulated key+value size a
+	// sub-transaction may have and still be opted into async-commit/1PC.
+	// Zero falls back to defaultTikvDBAsyncCommitMaxBytes.
+	FlagTikvDBAsyncCommitMaxBytes = "tikv.batch.async-commit.max-bytes"
+
+	// FlagTikvDBAsyncCommitMaxKeys caps the number of keys a sub-transaction
+	// may touch and still be opted into async-commit/1PC. Zero falls back to
+	// defaultTikvDBAsyncCommitMaxKeys.
+	FlagTikvDBAsyncCommitMaxKeys = "tikv.batch.async-commit.max-keys"
+)
+
+// defaultTikvDBBatchMaxBytes matches TiKV's default single-transaction size
+// limit, so a batch shard is never rejected for being too large.
+const defaultTikvDBBatchMaxBytes = 100 * 1024 * 1024
+
+// defaultTikvDBAsyncCommitMaxBytes and defaultTikvDBAsyncCommitMaxKeys bound
+// the sub-transactions TiKV's docs consider small enough for async-commit/
+// 1PC to actually reduce latency, which is a far smaller transaction than
+// FlagTikvDBBatchMaxBytes alone would allow.
+const (
+	defaultTikvDBAsyncCommitMaxBytes = 1 * 1024 * 1024
+	defaultTikvDBAsyncCommitMaxKeys  = 256
+)
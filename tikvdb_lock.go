@@ -0,0 +1,154 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	tikverr "github.com/tikv/client-go/v2/error"
+	"github.com/tikv/client-go/v2/tikv"
+)
+
+// tikvStateLeaseTTL is how long a state-key lease is honored before it is
+// considered abandoned and may be stolen by a new opener.
+const tikvStateLeaseTTL = 15 * time.Second
+
+// tikvStateLeaseRefresh is how often the background goroutine started by
+// NewTikvDBWithOpts renews its own lease. It runs well inside
+// tikvStateLeaseTTL so a single missed tick doesn't let another process
+// steal the lock out from under a live process.
+const tikvStateLeaseRefresh = tikvStateLeaseTTL / 3
+
+// tikvStateLease is the marker written to a TikvDB's state key while it
+// holds the key open for writing. It records enough to diagnose which
+// process is holding (or was holding) the lease.
+type tikvStateLease struct {
+	HolderID  string `json:"holder_id"`
+	ExpiresAt int64  `json:"expiry_ts"` // UnixNano
+	Hostname  string `json:"hostname"`
+	PID       int    `json:"pid"`
+}
+
+// newStateLeaseHolderID builds an identifier unique to this process and
+// open attempt, used both as the lease's holder_id and to recognize our
+// own lease on refresh.
+func newStateLeaseHolderID() string {
+	return fmt.Sprintf("%d-%d", os.Getpid(), time.Now().UnixNano())
+}
+
+// shouldStealStateLease reports whether lease may be taken over: always when
+// it is our own (its holder is ourHolderID), otherwise only once it has
+// expired as of now. It is split out of
+// acquireStateLease so the expiry decision can be unit tested without a live
+// TiKV cluster.
+func shouldStealStateLease(lease tikvStateLease, ourHolderID string, now time.Time) bool {
+	if lease.HolderID == ourHolderID {
+		return true
+	}
+	return now.UnixNano() >= lease.ExpiresAt
+}
+
+// acquireStateLease takes a pessimistic lock on t's state key and writes a
+// fresh lease, failing if another live holder already owns it. An expired
+// lease (its ExpiresAt in the past) is stolen with a logged warning rather
+// than treated as a conflict, matching TestTikvDBNewTikvDB's expectation
+// that only a second *live* open is rejected.
+func (t *TikvDB) acquireStateLease() error {
+	stateKey := t.getTikvStateKey()
+
+	kv, err := t.txn.Begin()
+	if err != nil {
+		return err
+	}
+	kv.SetPessimistic(true)
+
+	lockCtx := tikv.NewLockCtx(kv.StartTS(), uint64(tikvStateLeaseTTL.Milliseconds()), 0)
+	if err := kv.LockKeys(context.Background(), lockCtx, stateKey); err != nil {
+		_ = kv.Rollback()
+		return err
+	}
+
+	existing, err := kv.Get(context.Background(), stateKey)
+	if err != nil && !tikverr.IsErrNotFound(err) {
+		_ = kv.Rollback()
+		return err
+	}
+	if err == nil {
+		var lease tikvStateLease
+		if jsonErr := json.Unmarshal(existing, &lease); jsonErr == nil && lease.HolderID != t.holderID {
+			if !shouldStealStateLease(lease, t.holderID, time.Now()) {
+				_ = kv.Rollback()
+				return fmt.Errorf("held by holder %s (pid %d on %s) until %s",
+					lease.HolderID, lease.PID, lease.Hostname, time.Unix(0, lease.ExpiresAt))
+			}
+			fmt.Printf("tikvdb: stealing expired state lease for %q, last held by %s (pid %d on %s)\n",
+				stateKey, lease.HolderID, lease.PID, lease.Hostname)
+		}
+	}
+
+	if err := kv.Set(stateKey, t.encodeStateLease()); err != nil {
+		_ = kv.Rollback()
+		return err
+	}
+	return kv.Commit(context.Background())
+}
+
+// refreshStateLease renews t's lease every tikvStateLeaseRefresh until
+// Close signals t.stopLease, so the lock is held for as long as the
+// process keeps the database open without requiring the caller to do
+// anything.
+func (t *TikvDB) refreshStateLease() {
+	defer t.leaseWG.Done()
+
+	ticker := time.NewTicker(tikvStateLeaseRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.stopLease:
+			return
+		case <-ticker.C:
+			if err := t.acquireStateLease(); err != nil {
+				fmt.Printf("tikvdb: failed to refresh state lease for %q: %v\n", t.getTikvStateKey(), err)
+			}
+		}
+	}
+}
+
+// releaseStateLease deletes t's state key under its pessimistic lock, so a
+// concurrent opener can never observe the key half-deleted.
+func (t *TikvDB) releaseStateLease() error {
+	stateKey := t.getTikvStateKey()
+
+	kv, err := t.txn.Begin()
+	if err != nil {
+		return err
+	}
+	kv.SetPessimistic(true)
+
+	lockCtx := tikv.NewLockCtx(kv.StartTS(), uint64(tikvStateLeaseTTL.Milliseconds()), 0)
+	if err := kv.LockKeys(context.Background(), lockCtx, stateKey); err != nil {
+		_ = kv.Rollback()
+		return err
+	}
+
+	if err := kv.Delete(stateKey); err != nil {
+		_ = kv.Rollback()
+		return err
+	}
+	return kv.Commit(context.Background())
+}
+
+func (t *TikvDB) encodeStateLease() []byte {
+	hostname, _ := os.Hostname()
+	lease := tikvStateLease{
+		HolderID:  t.holderID,
+		ExpiresAt: time.Now().Add(tikvStateLeaseTTL).UnixNano(),
+		Hostname:  hostname,
+		PID:       os.Getpid(),
+	}
+	data, _ := json.Marshal(lease)
+	return data
+}
@@ -0,0 +1,29 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShouldStealStateLeaseOwnLease(t *testing.T) {
+	lease := tikvStateLease{HolderID: "holder-a", ExpiresAt: time.Now().Add(time.Hour).UnixNano()}
+	require.True(t, shouldStealStateLease(lease, "holder-a", time.Now()))
+}
+
+func TestShouldStealStateLeaseOtherLiveLease(t *testing.T) {
+	lease := tikvStateLease{HolderID: "holder-a", ExpiresAt: time.Now().Add(time.Hour).UnixNano()}
+	require.False(t, shouldStealStateLease(lease, "holder-b", time.Now()))
+}
+
+func TestShouldStealStateLeaseOtherExpiredLease(t *testing.T) {
+	lease := tikvStateLease{HolderID: "holder-a", ExpiresAt: time.Now().Add(-time.Hour).UnixNano()}
+	require.True(t, shouldStealStateLease(lease, "holder-b", time.Now()))
+}
+
+func TestShouldStealStateLeaseExpiresExactlyNow(t *testing.T) {
+	now := time.Now()
+	lease := tikvStateLease{HolderID: "holder-a", ExpiresAt: now.UnixNano()}
+	require.True(t, shouldStealStateLease(lease, "holder-b", now))
+}
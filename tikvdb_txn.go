@@ -0,0 +1,417 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	tikverr "github.com/tikv/client-go/v2/error"
+	"github.com/tikv/client-go/v2/tikv"
+	"github.com/tikv/client-go/v2/txnkv/transaction"
+	"github.com/tikv/client-go/v2/txnkv/txnsnapshot"
+)
+
+// IsolationLevel selects the consistency guarantee a Txn operates under,
+// mirroring transaction.KVTxn.SetIsolationLevel.
+type IsolationLevel int
+
+const (
+	// IsolationSI is snapshot isolation, the default.
+	IsolationSI IsolationLevel = iota
+	// IsolationRC is read-committed isolation.
+	IsolationRC
+)
+
+// TxnPriority hints TiKV's scheduler about how to order this transaction's
+// writes relative to others.
+type TxnPriority int
+
+const (
+	PriorityNormal TxnPriority = iota
+	PriorityLow
+	PriorityHigh
+)
+
+// TxnOptions configures a transaction started with TikvDB.BeginTxn.
+type TxnOptions struct {
+	// Pessimistic selects pessimistic locking (transaction.KVTxn.SetPessimistic)
+	// instead of the default optimistic mode.
+	Pessimistic bool
+	// Isolation selects the isolation level; zero value is IsolationSI.
+	Isolation IsolationLevel
+	// LockTTL is the lock lease, in milliseconds, used for GetForUpdate and
+	// LockKeys under pessimistic mode. Zero uses TiKV's default TTL.
+	LockTTL uint64
+	// ForUpdateTS pins the transaction's for-update timestamp, e.g. to retry
+	// a pessimistic lock acquisition at the timestamp of a prior attempt.
+	// Zero locks at the transaction's start timestamp.
+	ForUpdateTS uint64
+	// Priority hints the scheduler about relative importance; zero is
+	// PriorityNormal.
+	Priority TxnPriority
+}
+
+// Txn is a multi-key, ACID transaction against a TikvDB. Unlike the
+// implicit per-call transactions TikvDB.Get/Set/Delete use, a Txn lets
+// callers group several reads and writes so they commit or roll back
+// together.
+type Txn interface {
+	Get(key []byte) ([]byte, error)
+	// GetForUpdate reads key and takes a pessimistic lock on it, so that no
+	// other transaction can modify it until this one commits or rolls back.
+	GetForUpdate(key []byte) ([]byte, error)
+	Set(key, value []byte) error
+	Delete(key []byte) error
+	Iterator(start, end []byte) (Iterator, error)
+	ReverseIterator(start, end []byte) (Iterator, error)
+	// LockKeys takes a pessimistic lock on each key without reading them.
+	LockKeys(keys [][]byte) error
+	Commit() error
+	Rollback() error
+}
+
+// tikvTxn implements Txn on top of a single transaction.KVTxn. It stages the
+// key-level effect of every Set/Delete it applies so that, on a successful
+// Commit, the host TikvDB's cache (if any) can be brought back in sync with
+// what was actually committed - the same contract setKV/deleteKey/Batch.Write
+// give readers outside of a Txn.
+type tikvTxn struct {
+	ctx         context.Context
+	db          *TikvDB
+	kv          *transaction.KVTxn
+	lockTTL     uint64
+	forUpdateTS uint64
+	writes      []keyvalue
+}
+
+var _ Txn = (*tikvTxn)(nil)
+
+// BeginTxn starts a new transaction against t, configured per opts. ctx
+// governs every subsequent call on the returned Txn, including Commit. The
+// returned Txn must be finished with exactly one call to Commit or
+// Rollback.
+func (t *TikvDB) BeginTxn(ctx context.Context, opts TxnOptions) (Txn, error) {
+	kv, err := t.txn.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Pessimistic {
+		kv.SetPessimistic(true)
+	}
+	switch opts.Isolation {
+	case IsolationRC:
+		kv.SetIsolationLevel(transaction.RC)
+	default:
+		kv.SetIsolationLevel(transaction.SI)
+	}
+	switch opts.Priority {
+	case PriorityLow:
+		kv.SetPriority(transaction.PriorityLow)
+	case PriorityHigh:
+		kv.SetPriority(transaction.PriorityHigh)
+	default:
+		kv.SetPriority(transaction.PriorityNormal)
+	}
+	if opts.ForUpdateTS != 0 {
+		kv.SetForUpdateTS(opts.ForUpdateTS)
+	}
+
+	return &tikvTxn{ctx: ctx, db: t, kv: kv, lockTTL: opts.LockTTL, forUpdateTS: opts.ForUpdateTS}, nil
+}
+
+func (x *tikvTxn) lockCtx() *tikv.LockCtx {
+	forUpdateTS := x.forUpdateTS
+	if forUpdateTS == 0 {
+		forUpdateTS = x.kv.StartTS()
+	}
+	return tikv.NewLockCtx(forUpdateTS, x.lockTTL, 0)
+}
+
+func (x *tikvTxn) Get(key []byte) ([]byte, error) {
+	val, err := x.kv.Get(x.ctx, x.db.getTikvKey(key))
+	if err != nil {
+		if tikverr.IsErrNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return checkEmptyValue(val), nil
+}
+
+func (x *tikvTxn) GetForUpdate(key []byte) ([]byte, error) {
+	tikvKey := x.db.getTikvKey(key)
+	if err := x.kv.LockKeys(x.ctx, x.lockCtx(), tikvKey); err != nil {
+		return nil, err
+	}
+	return x.Get(key)
+}
+
+func (x *tikvTxn) Set(key, value []byte) error {
+	tikvKey := x.db.getTikvKey(key)
+	if err := x.kv.Set(tikvKey, setNotEmptyValue(value)); err != nil {
+		return err
+	}
+	x.writes = append(x.writes, keyvalue{tikvKey, cp(value), false})
+	return nil
+}
+
+func (x *tikvTxn) Delete(key []byte) error {
+	tikvKey := x.db.getTikvKey(key)
+	if err := x.kv.Delete(tikvKey); err != nil {
+		return err
+	}
+	x.writes = append(x.writes, keyvalue{tikvKey, nil, true})
+	return nil
+}
+
+func (x *tikvTxn) Iterator(start, end []byte) (Iterator, error) {
+	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
+		return nil, errKeyEmpty
+	}
+	return newTikvTxnIterator(x.kv, []byte(x.db.tikvStoreKeyPrefix()), start, end, false)
+}
+
+func (x *tikvTxn) ReverseIterator(start, end []byte) (Iterator, error) {
+	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
+		return nil, errKeyEmpty
+	}
+	return newTikvTxnIterator(x.kv, []byte(x.db.tikvStoreKeyPrefix()), start, end, true)
+}
+
+func (x *tikvTxn) LockKeys(keys [][]byte) error {
+	tikvKeys := make([][]byte, len(keys))
+	for i, key := range keys {
+		tikvKeys[i] = x.db.getTikvKey(key)
+	}
+	return x.kv.LockKeys(x.ctx, x.lockCtx(), tikvKeys...)
+}
+
+// Commit commits the transaction and, if that succeeds, brings the host
+// TikvDB's cache back in sync with every key this Txn wrote - mirroring
+// setKV/deleteKey/Batch.Write, which update the cache only after their own
+// commit succeeds.
+func (x *tikvTxn) Commit() error {
+	if err := x.kv.Commit(x.ctx); err != nil {
+		return err
+	}
+	if x.db.cache != nil {
+		for _, write := range x.writes {
+			if write.delete {
+				x.db.cache.Delete(write.key)
+			} else {
+				x.db.cache.Set(write.key, write.value)
+			}
+		}
+	}
+	return nil
+}
+
+func (x *tikvTxn) Rollback() error {
+	return x.kv.Rollback()
+}
+
+// newTikvTxnIterator adapts newTikvDBIterator to a transaction.KVTxn owned by
+// a Txn (as opposed to TikvDB.Iterator, whose per-iterator transaction is
+// committed by the iterator's Close), since closing it is the caller's responsibility via
+// Txn.Commit/Rollback rather than the iterator's Close.
+func newTikvTxnIterator(kv *transaction.KVTxn, prefix, start, end []byte, isReverse bool) (Iterator, error) {
+	itr, err := newTikvDBIterator(kv, prefix, start, end, isReverse)
+	if err != nil {
+		return nil, err
+	}
+	return &noCommitIterator{tikvDBIterator: itr}, nil
+}
+
+// noCommitIterator wraps a tikvDBIterator so Close only releases the
+// underlying scan cursor, leaving the owning transaction's lifecycle to the
+// caller of Txn.Commit/Rollback.
+type noCommitIterator struct {
+	*tikvDBIterator
+}
+
+func (itr *noCommitIterator) Close() error {
+	itr.source.Close()
+	return nil
+}
+
+// Snapshot is a read-only, point-in-time view of a TikvDB at a specific PD
+// timestamp, obtained via TikvDB.Snapshot. It is useful for consistent
+// historical range scans that must not be affected by writes committed
+// after ts.
+type Snapshot interface {
+	Get(key []byte) ([]byte, error)
+	Iterator(start, end []byte) (Iterator, error)
+	ReverseIterator(start, end []byte) (Iterator, error)
+}
+
+// tikvSnapshot implements Snapshot on top of txnkv.Client.GetSnapshot, which
+// reads TiKV as it was at a fixed TSO regardless of later commits.
+type tikvSnapshot struct {
+	db  *TikvDB
+	snp *txnsnapshot.KVSnapshot
+}
+
+var _ Snapshot = (*tikvSnapshot)(nil)
+
+// Snapshot opens a read-only view of t as of the TSO ts.
+func (t *TikvDB) Snapshot(ts uint64) (Snapshot, error) {
+	return &tikvSnapshot{db: t, snp: t.txn.GetSnapshot(ts)}, nil
+}
+
+func (s *tikvSnapshot) Get(key []byte) ([]byte, error) {
+	val, err := s.snp.Get(context.Background(), s.db.getTikvKey(key))
+	if err != nil {
+		if tikverr.IsErrNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return checkEmptyValue(val), nil
+}
+
+func (s *tikvSnapshot) Iterator(start, end []byte) (Iterator, error) {
+	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
+		return nil, errKeyEmpty
+	}
+	return newTikvSnapshotIterator(s.snp, []byte(s.db.tikvStoreKeyPrefix()), start, end, false)
+}
+
+func (s *tikvSnapshot) ReverseIterator(start, end []byte) (Iterator, error) {
+	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
+		return nil, errKeyEmpty
+	}
+	return newTikvSnapshotIterator(s.snp, []byte(s.db.tikvStoreKeyPrefix()), start, end, true)
+}
+
+// tikvSnapshotIterator mirrors tikvDBIterator's prefix/bounds handling, but
+// scans a fixed txnsnapshot.KVSnapshot instead of a live transaction.KVTxn,
+// and has nothing to commit on Close.
+type tikvSnapshotIterator struct {
+	source    tikv.Iterator
+	prefix    []byte
+	start     []byte
+	end       []byte
+	isReverse bool
+	isValid   bool
+	err       error
+}
+
+var _ Iterator = (*tikvSnapshotIterator)(nil)
+
+func newTikvSnapshotIterator(snp *txnsnapshot.KVSnapshot, prefix, start, end []byte, isReverse bool) (*tikvSnapshotIterator, error) {
+	var endKey = []byte("~")
+	itr := &tikvSnapshotIterator{
+		prefix:    prefix,
+		start:     start,
+		end:       end,
+		isReverse: isReverse,
+		isValid:   true,
+	}
+
+	var source tikv.Iterator
+	var err error
+	if isReverse {
+		startKey := itr.getTikvKey(endKey)
+		if end != nil {
+			startKey = itr.getTikvKey(end)
+		}
+		source, err = snp.IterReverse(startKey, nil)
+		if err != nil {
+			return nil, err
+		}
+		// IterReverse starting from end can come back invalid depending on
+		// where end falls relative to the stored keys; retry from the
+		// absolute prefix-end, matching newTikvDBIterator's fallback.
+		if !source.Valid() {
+			source, err = snp.IterReverse(itr.getTikvKey(endKey), nil)
+		}
+	} else {
+		startKey := itr.getTikvKey(nil)
+		if start != nil {
+			startKey = itr.getTikvKey(start)
+		}
+		source, err = snp.Iter(startKey, itr.getTikvKey(endKey))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	itr.source = source
+	return itr, nil
+}
+
+func (itr *tikvSnapshotIterator) Domain() (start []byte, end []byte) {
+	return itr.start, itr.end
+}
+
+func (itr *tikvSnapshotIterator) Valid() bool {
+	key := itr.source.Key()
+
+	if itr.isReverse {
+		if itr.start != nil && bytes.Compare(key, itr.getTikvKey(itr.start)) < 0 {
+			itr.isValid = false
+			return false
+		}
+	} else {
+		if itr.end != nil && bytes.Compare(itr.getTikvKey(itr.end), key) <= 0 {
+			itr.isValid = false
+			return false
+		}
+	}
+
+	if !itr.isValid || itr.err != nil || !itr.source.Valid() {
+		return false
+	}
+
+	if len(key) < len(itr.prefix) || !bytes.Equal(key[:len(itr.prefix)], itr.prefix) {
+		itr.isValid = false
+		itr.err = fmt.Errorf("received invalid key from backend: %x (expected prefix %x)", key, itr.prefix)
+		return false
+	}
+
+	return true
+}
+
+func (itr *tikvSnapshotIterator) Next() {
+	itr.assertIsValid()
+	if err := itr.source.Next(); err != nil {
+		itr.err = err
+	}
+
+	if !itr.source.Valid() || !bytes.HasPrefix(itr.source.Key(), itr.prefix) {
+		itr.isValid = false
+	} else if bytes.Equal(itr.source.Key(), itr.prefix) {
+		itr.Next()
+	}
+}
+
+func (itr *tikvSnapshotIterator) Key() (key []byte) {
+	itr.assertIsValid()
+	fullKey := itr.source.Key()
+	return fullKey[len(itr.prefix):]
+}
+
+func (itr *tikvSnapshotIterator) Value() (value []byte) {
+	itr.assertIsValid()
+	return checkEmptyValue(itr.source.Value())
+}
+
+func (itr *tikvSnapshotIterator) Error() error {
+	return itr.err
+}
+
+func (itr *tikvSnapshotIterator) Close() error {
+	itr.source.Close()
+	return nil
+}
+
+func (itr *tikvSnapshotIterator) assertIsValid() {
+	if !itr.Valid() {
+		panic("iterator is invalid")
+	}
+}
+
+func (itr *tikvSnapshotIterator) getTikvKey(key []byte) []byte {
+	return append(cp(itr.prefix), key...)
+}